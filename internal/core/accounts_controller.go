@@ -0,0 +1,246 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Account replaces the flat gin.Accounts username->password map with a hashed credential plus the role
+// and, for guests, the subset of services they may see.
+type Account struct {
+	Username        string   `json:"username" bson:"_id"`
+	PasswordHash    string   `json:"-" bson:"password_hash"`
+	Role            Role     `json:"role" bson:"role"`
+	AllowedServices []string `json:"allowed_services,omitempty" bson:"allowed_services,omitempty"`
+}
+
+func (a Account) allowsService(serviceID string) bool {
+	for _, allowed := range a.AllowedServices {
+		if allowed == serviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// AccountsController manages the Mongo-backed account collection used for authentication and RBAC.
+type AccountsController struct {
+	accounts Storage
+}
+
+// NewAccountsController returns an AccountsController backed by the accounts collection.
+func NewAccountsController(applicationContext *ApplicationContext) AccountsController {
+	return AccountsController{accounts: applicationContext.Storage("accounts")}
+}
+
+// GetAccounts returns every registered account. PasswordHash is populated, but is never serialized to JSON.
+func (ac AccountsController) GetAccounts(ctx context.Context) []Account {
+	var accounts []Account
+	ac.accounts.Find(ctx, OrderedDocument{}, &accounts)
+	return accounts
+}
+
+// GetAccount returns the account with the given username, if present.
+func (ac AccountsController) GetAccount(username string) (Account, bool) {
+	var account Account
+	isPresent := ac.accounts.FindOne(context.Background(), OrderedDocument{{"_id", username}}, &account)
+	return account, isPresent
+}
+
+// CreateAccount hashes password and inserts a new account with the given role.
+func (ac AccountsController) CreateAccount(ctx context.Context, username, password string, role Role,
+	allowedServices []string) error {
+	if _, isPresent := ac.GetAccount(username); isPresent {
+		return errors.New("account already exists")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	account := Account{
+		Username:        username,
+		PasswordHash:    string(hash),
+		Role:            role,
+		AllowedServices: allowedServices,
+	}
+	_, err = ac.accounts.Insert(ctx, account)
+	return err
+}
+
+// UpdateAccount changes the role and allowed services of an existing account, and its password if given.
+func (ac AccountsController) UpdateAccount(ctx context.Context, username string, role Role,
+	allowedServices []string, password string) (bool, error) {
+	account, isPresent := ac.GetAccount(username)
+	if !isPresent {
+		return false, nil
+	}
+
+	account.Role = role
+	account.AllowedServices = allowedServices
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return false, err
+		}
+		account.PasswordHash = string(hash)
+	}
+
+	if err := ac.accounts.Update(ctx, account.Username, account); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteAccount removes an account, refusing to delete the last remaining admin.
+func (ac AccountsController) DeleteAccount(ctx context.Context, username string) (bool, error) {
+	account, isPresent := ac.GetAccount(username)
+	if !isPresent {
+		return false, nil
+	}
+
+	if account.Role == RoleAdmin && ac.countAdmins(ctx) <= 1 {
+		return false, errors.New("cannot delete the last admin account")
+	}
+
+	return true, ac.accounts.Delete(ctx, username)
+}
+
+// Authenticate verifies a username/password pair against the stored bcrypt hash.
+func (ac AccountsController) Authenticate(username, password string) (Account, bool) {
+	account, isPresent := ac.GetAccount(username)
+	if !isPresent {
+		return Account{}, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		return Account{}, false
+	}
+	return account, true
+}
+
+func (ac AccountsController) countAdmins(ctx context.Context) int {
+	count := 0
+	for _, account := range ac.GetAccounts(ctx) {
+		if account.Role == RoleAdmin {
+			count++
+		}
+	}
+	return count
+}
+
+// accountsRoutes registers the admin-only /api/accounts CRUD endpoints on the given router group.
+func accountsRoutes(api *gin.RouterGroup, applicationContext *ApplicationContext, authController AuthController) {
+	accounts := currentAccountsController()
+
+	api.GET("/accounts", RequirePermission(applicationContext, "/accounts", ActionRead), func(c *gin.Context) {
+		success(c, accounts.GetAccounts(c))
+	})
+
+	api.POST("/accounts", RequirePermission(applicationContext, "/accounts", ActionWrite), func(c *gin.Context) {
+		var request struct {
+			Username        string   `json:"username" binding:"required"`
+			Password        string   `json:"password" binding:"required"`
+			Role            Role     `json:"role" binding:"required"`
+			AllowedServices []string `json:"allowed_services"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		if err := accounts.CreateAccount(c, request.Username, request.Password, request.Role,
+			request.AllowedServices); err != nil {
+			unprocessableEntity(c, err)
+			return
+		}
+		success(c, UnorderedDocument{"username": request.Username})
+	})
+
+	api.PUT("/accounts/:username", RequirePermission(applicationContext, "/accounts", ActionWrite),
+		func(c *gin.Context) {
+			var request struct {
+				Password        string   `json:"password"`
+				Role            Role     `json:"role" binding:"required"`
+				AllowedServices []string `json:"allowed_services"`
+			}
+			if err := c.ShouldBindJSON(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			username := c.Param("username")
+			isPresent, err := accounts.UpdateAccount(c, username, request.Role, request.AllowedServices,
+				request.Password)
+			if err != nil {
+				unprocessableEntity(c, err)
+				return
+			} else if !isPresent {
+				notFound(c, UnorderedDocument{"error": "not found", "username": username})
+				return
+			}
+
+			if request.Password != "" {
+				if err := authController.RevokeAllForUsername(c, username); err != nil {
+					log.WithError(err).Error("failed to revoke refresh tokens after password change")
+				}
+			}
+			success(c, UnorderedDocument{"username": username})
+		})
+
+	api.DELETE("/accounts/:username", RequirePermission(applicationContext, "/accounts", ActionDelete),
+		func(c *gin.Context) {
+			username := c.Param("username")
+			isPresent, err := accounts.DeleteAccount(c, username)
+			if err != nil {
+				unprocessableEntity(c, err)
+				return
+			} else if !isPresent {
+				notFound(c, UnorderedDocument{"error": "not found", "username": username})
+				return
+			}
+
+			if err := authController.RevokeAllForUsername(c, username); err != nil {
+				log.WithError(err).Error("failed to revoke refresh tokens after account deletion")
+			}
+			success(c, UnorderedDocument{"username": username})
+		})
+
+	// force logout revokes every outstanding refresh token for an account without deleting it, e.g. so
+	// an admin can end a compromised or stale session immediately instead of waiting out refreshTokenTTL.
+	api.POST("/accounts/:username/logout", RequirePermission(applicationContext, "/accounts", ActionWrite),
+		func(c *gin.Context) {
+			username := c.Param("username")
+			if _, isPresent := accounts.GetAccount(username); !isPresent {
+				notFound(c, UnorderedDocument{"error": "not found", "username": username})
+				return
+			}
+
+			if err := authController.RevokeAllForUsername(c, username); err != nil {
+				unprocessableEntity(c, err)
+				return
+			}
+			success(c, UnorderedDocument{"username": username})
+		})
+}
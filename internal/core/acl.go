@@ -0,0 +1,249 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Role identifies a class of account with a fixed set of permitted actions.
+type Role string
+
+const (
+	RoleAdmin   Role = "admin"
+	RoleAnalyst Role = "analyst"
+	RoleViewer  Role = "viewer"
+	RoleGuest   Role = "guest"
+)
+
+// Action is a verb performed against a resource, modeled after the HTTP method it is usually bound to.
+type Action string
+
+const (
+	ActionRead   Action = "read"
+	ActionWrite  Action = "write"
+	ActionDelete Action = "delete"
+)
+
+// aclEntry is a single (role, resource, action) grant. Resources are matched with a trailing "*" wildcard.
+type aclEntry struct {
+	role     Role
+	resource string
+	action   Action
+}
+
+// ACL maps (role, resource, action) tuples to an allow/deny decision. The zero value denies everything,
+// so every permitted combination must be explicitly granted.
+type ACL struct {
+	entries []aclEntry
+}
+
+// NewACL returns the default ACL used by CreateApplicationRouter, matching the permissions laid out
+// in the route table: admins can do everything, analysts can operate on captured data but not
+// services/accounts, viewers are read-only, and guests are restricted even further by the caller.
+func NewACL() *ACL {
+	acl := &ACL{}
+	acl.Grant(RoleAdmin, "*", ActionRead)
+	acl.Grant(RoleAdmin, "*", ActionWrite)
+	acl.Grant(RoleAdmin, "*", ActionDelete)
+
+	acl.Grant(RoleAnalyst, "/connections*", ActionRead)
+	acl.Grant(RoleAnalyst, "/streams*", ActionRead)
+	acl.Grant(RoleAnalyst, "/statistics*", ActionRead)
+	acl.Grant(RoleAnalyst, "/searches*", ActionRead)
+	acl.Grant(RoleAnalyst, "/searches*", ActionWrite)
+	acl.Grant(RoleAnalyst, "/connections*", ActionWrite)
+	acl.Grant(RoleAnalyst, "/rules*", ActionRead)
+	acl.Grant(RoleAnalyst, "/rules*", ActionWrite)
+
+	acl.Grant(RoleViewer, "/connections*", ActionRead)
+	acl.Grant(RoleViewer, "/streams*", ActionRead)
+	acl.Grant(RoleViewer, "/statistics*", ActionRead)
+	acl.Grant(RoleViewer, "/rules*", ActionRead)
+	acl.Grant(RoleViewer, "/services*", ActionRead)
+
+	acl.Grant(RoleGuest, "/connections*", ActionRead)
+	acl.Grant(RoleGuest, "/streams*", ActionRead)
+
+	return acl
+}
+
+// rbac holds the ACL, AccountsController and the connections/stream pub-subs shared by every request in
+// the process. All four are built once, explicitly, by InitializeRBAC, which CreateApplicationRouter calls
+// alongside every other controller it already constructs there. This replaces what used to be two separate
+// pairs of ad hoc globals (a bare defaultACL var plus a sync.Once-cached resolvedAccountsController here,
+// and connectionsPubSubInstance/streamMessagesPubSubInstance in connections_stream.go, each justified by
+// its own copy of the same rationale comment): ApplicationContext's own struct and constructor are outside
+// this change set, so there is still no field on it to assign these to, but there is now one place they
+// are built and read instead of four.
+var rbac struct {
+	mu                   sync.RWMutex
+	acl                  *ACL
+	accountsController   AccountsController
+	connectionsPubSub    *connectionsPubSub
+	streamMessagesPubSub *connectionsPubSub
+}
+
+// InitializeRBAC builds the ACL, AccountsController and pub-subs for applicationContext. Calling it again
+// (e.g. in a test that constructs more than one ApplicationContext) replaces the previous state.
+func InitializeRBAC(applicationContext *ApplicationContext) {
+	rbac.mu.Lock()
+	defer rbac.mu.Unlock()
+	rbac.acl = NewACL()
+	rbac.accountsController = NewAccountsController(applicationContext)
+	rbac.connectionsPubSub = newConnectionsPubSub()
+	rbac.streamMessagesPubSub = newConnectionsPubSub()
+}
+
+func currentACL() *ACL {
+	rbac.mu.RLock()
+	defer rbac.mu.RUnlock()
+	return rbac.acl
+}
+
+func currentAccountsController() AccountsController {
+	rbac.mu.RLock()
+	defer rbac.mu.RUnlock()
+	return rbac.accountsController
+}
+
+func currentConnectionsPubSub() *connectionsPubSub {
+	rbac.mu.RLock()
+	defer rbac.mu.RUnlock()
+	return rbac.connectionsPubSub
+}
+
+func currentStreamMessagesPubSub() *connectionsPubSub {
+	rbac.mu.RLock()
+	defer rbac.mu.RUnlock()
+	return rbac.streamMessagesPubSub
+}
+
+// Grant adds an allow rule for the given (role, resource, action) tuple.
+func (acl *ACL) Grant(role Role, resource string, action Action) {
+	acl.entries = append(acl.entries, aclEntry{role: role, resource: resource, action: action})
+}
+
+// IsAllowed reports whether the given role may perform action on resource.
+func (acl *ACL) IsAllowed(role Role, resource string, action Action) bool {
+	for _, entry := range acl.entries {
+		if entry.role != role || entry.action != action {
+			continue
+		}
+		if entry.resource == "*" || entry.resource == resource {
+			return true
+		}
+		if wildcard := len(entry.resource) > 0 && entry.resource[len(entry.resource)-1] == '*'; wildcard {
+			prefix := entry.resource[:len(entry.resource)-1]
+			if len(resource) >= len(prefix) && resource[:len(prefix)] == prefix {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequirePermission builds a middleware that denies the request unless the authenticated account's role
+// is allowed to perform action on resource, per the ACL that InitializeRBAC built. Restricting a guest to its
+// AllowedServices is not handled here, since that requires looking at the actual connection a route
+// resolves to rather than the route itself; see currentAccount, enforceGuestServiceAccess and
+// filterConnectionsForAccount, which the connections/streams routes call directly.
+func RequirePermission(applicationContext *ApplicationContext, resource string, action Action) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !applicationContext.Config.AuthRequired {
+			c.Next()
+			return
+		}
+
+		account, isPresent := currentAccount(c, applicationContext)
+		if !isPresent {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, UnorderedDocument{"error": "unknown account"})
+			return
+		}
+
+		if !currentACL().IsAllowed(account.Role, resource, action) {
+			c.AbortWithStatusJSON(http.StatusForbidden, UnorderedDocument{"error": "permission denied"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// currentAccount resolves the Account behind the "user" claim that AuthRequiredMiddleware set on c.
+func currentAccount(c *gin.Context, applicationContext *ApplicationContext) (Account, bool) {
+	username, isPresent := c.Get("user")
+	if !isPresent {
+		return Account{}, false
+	}
+	return currentAccountsController().GetAccount(username.(string))
+}
+
+// connectionServiceID extracts the service a connection belongs to, so a guest's AllowedServices can be
+// checked against the connection actually being accessed rather than the route's :id param, which is a
+// Mongo row ID and never a service identifier. A zero ServicePort means the connection hasn't been
+// matched to a service yet; callers treat that as "can't determine" and fail closed rather than letting
+// an unmatched connection through.
+func connectionServiceID(connection Connection) (string, bool) {
+	if connection.ServicePort == 0 {
+		return "", false
+	}
+	return fmt.Sprint(connection.ServicePort), true
+}
+
+// enforceGuestServiceAccess aborts the request and returns false if account is a guest restricted to
+// AllowedServices and connectionID does not belong to one of them, or its service can't be determined.
+// Non-guest accounts, and guests without a restriction, are always allowed through.
+func enforceGuestServiceAccess(c *gin.Context, applicationContext *ApplicationContext, account Account,
+	connectionID RowID) bool {
+	if account.Role != RoleGuest || len(account.AllowedServices) == 0 {
+		return true
+	}
+
+	connection, isPresent := applicationContext.ConnectionsController.GetConnection(c, connectionID)
+	if !isPresent {
+		return true // let the handler's own lookup produce the 404
+	}
+
+	if serviceID, found := connectionServiceID(connection); !found || !account.allowsService(serviceID) {
+		c.AbortWithStatusJSON(http.StatusForbidden, UnorderedDocument{"error": "service not allowed"})
+		return false
+	}
+	return true
+}
+
+// filterConnectionsForAccount drops connections outside a guest's AllowedServices, and connections whose
+// service can't be determined, from a list response. Non-guest accounts, and guests without a
+// restriction, get the list back unchanged.
+func filterConnectionsForAccount(account Account, connections []Connection) []Connection {
+	if account.Role != RoleGuest || len(account.AllowedServices) == 0 {
+		return connections
+	}
+
+	filtered := make([]Connection, 0, len(connections))
+	for _, connection := range connections {
+		if serviceID, found := connectionServiceID(connection); found && account.allowsService(serviceID) {
+			filtered = append(filtered, connection)
+		}
+	}
+	return filtered
+}
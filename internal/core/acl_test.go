@@ -0,0 +1,65 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import "testing"
+
+func TestACLIsAllowed(t *testing.T) {
+	acl := NewACL()
+
+	cases := []struct {
+		name     string
+		role     Role
+		resource string
+		action   Action
+		want     bool
+	}{
+		{"admin can delete anything", RoleAdmin, "/accounts", ActionDelete, true},
+		{"analyst can write connections", RoleAnalyst, "/connections/123", ActionWrite, true},
+		{"analyst cannot write accounts", RoleAnalyst, "/accounts", ActionWrite, false},
+		{"viewer can read services", RoleViewer, "/services", ActionRead, true},
+		{"viewer cannot write services", RoleViewer, "/services", ActionWrite, false},
+		{"guest can read streams", RoleGuest, "/streams/1", ActionRead, true},
+		{"guest cannot read accounts", RoleGuest, "/accounts", ActionRead, false},
+		{"unknown role is denied by default", Role("unknown"), "/connections", ActionRead, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := acl.IsAllowed(tc.role, tc.resource, tc.action); got != tc.want {
+				t.Errorf("IsAllowed(%s, %s, %s) = %v, want %v", tc.role, tc.resource, tc.action, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAccountAllowsService(t *testing.T) {
+	account := Account{Role: RoleGuest, AllowedServices: []string{"80", "443"}}
+
+	if !account.allowsService("80") {
+		t.Error("expected account to allow service 80")
+	}
+	if account.allowsService("22") {
+		t.Error("expected account to not allow service 22")
+	}
+
+	unrestricted := Account{Role: RoleGuest}
+	if unrestricted.allowsService("80") {
+		t.Error("expected an account with no AllowedServices to not allow any service via allowsService")
+	}
+}
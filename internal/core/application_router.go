@@ -26,6 +26,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
@@ -40,6 +41,8 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 
 	router.Use(static.Serve("/", static.LocalFile("./web/build", true)))
 
+	InitializeRBAC(applicationContext)
+
 	for _, path := range []string{"/connections/:id", "/pcaps", "/rules", "/services", "/stats", "/searches", "/capture"} {
 		router.GET(path, func(c *gin.Context) {
 			c.File("./web/build/index.html")
@@ -53,18 +56,42 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 		}
 
 		var settings struct {
-			Config   Config       `json:"config" binding:"required"`
-			Accounts gin.Accounts `json:"accounts" binding:"required"`
+			Config        Config       `json:"config" binding:"required"`
+			Accounts      gin.Accounts `json:"accounts" binding:"required"`
+			AdminUsername string       `json:"admin_username" binding:"required"`
 		}
 
 		if err := c.ShouldBindJSON(&settings); err != nil {
 			badRequest(c, err)
 			return
 		}
+		if _, isPresent := settings.Accounts[settings.AdminUsername]; !isPresent {
+			badRequest(c, errors.New("admin_username must be one of the configured accounts"))
+			return
+		}
 
 		applicationContext.SetConfig(settings.Config)
 		applicationContext.SetAccounts(settings.Accounts)
 
+		if jwtSecret, err := GenerateJWTSecret(); err != nil {
+			log.WithError(err).Panic("failed to generate jwt secret")
+		} else {
+			SetJWTSecret(jwtSecret)
+		}
+
+		// admin_username names the account that becomes admin; every other configured account defaults
+		// to analyst. gin.Accounts is a map, so its iteration order can't be trusted to pick "the first".
+		for username, password := range settings.Accounts {
+			role := RoleAnalyst
+			if username == settings.AdminUsername {
+				role = RoleAdmin
+			}
+			if err := currentAccountsController().CreateAccount(c, username, password, role,
+				nil); err != nil {
+				log.WithError(err).Panic("failed to migrate account")
+			}
+		}
+
 		c.JSON(http.StatusAccepted, gin.H{})
 		notificationController.Notify("setup", gin.H{})
 	})
@@ -75,6 +102,15 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 		}
 	})
 
+	authController := NewAuthController(applicationContext)
+	authApi := router.Group("/api/auth")
+	authApi.Use(SetupRequiredMiddleware(applicationContext))
+	{
+		authApi.POST("/login", authController.Login)
+		authApi.POST("/refresh", authController.Refresh)
+		authApi.POST("/logout", authController.Logout)
+	}
+
 	api := router.Group("/api")
 	api.Use(SetupRequiredMiddleware(applicationContext))
 	api.Use(AuthRequiredMiddleware(applicationContext))
@@ -83,11 +119,14 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			success(c, applicationContext.Status())
 		})
 
-		api.GET("/rules", func(c *gin.Context) {
+		api.GET("/auth/me", authController.Me)
+		accountsRoutes(api, applicationContext, authController)
+
+		api.GET("/rules", RequirePermission(applicationContext, "/rules", ActionRead), func(c *gin.Context) {
 			success(c, applicationContext.RulesManager.GetRules())
 		})
 
-		api.POST("/rules", func(c *gin.Context) {
+		api.POST("/rules", RequirePermission(applicationContext, "/rules", ActionWrite), func(c *gin.Context) {
 			var rule Rule
 
 			if err := c.ShouldBindJSON(&rule); err != nil {
@@ -104,7 +143,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.GET("/rules/:id", func(c *gin.Context) {
+		api.GET("/rules/:id", RequirePermission(applicationContext, "/rules", ActionRead), func(c *gin.Context) {
 			hex := c.Param("id")
 			id, err := RowIDFromHex(hex)
 			if err != nil {
@@ -119,7 +158,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.PUT("/rules/:id", func(c *gin.Context) {
+		api.PUT("/rules/:id", RequirePermission(applicationContext, "/rules", ActionWrite), func(c *gin.Context) {
 			hex := c.Param("id")
 			id, err := RowIDFromHex(hex)
 			if err != nil {
@@ -143,7 +182,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.POST("/pcap/upload", func(c *gin.Context) {
+		api.POST("/pcap/upload", RequirePermission(applicationContext, "/pcap", ActionWrite), func(c *gin.Context) {
 			fileHeader, err := c.FormFile("file")
 			if err != nil {
 				badRequest(c, err)
@@ -165,7 +204,17 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.POST("/pcap/file", func(c *gin.Context) {
+		pcapUploadController := NewPcapUploadController(applicationContext, notificationController)
+		api.POST("/pcap/upload/init", RequirePermission(applicationContext, "/pcap", ActionWrite),
+			pcapUploadController.Init)
+		api.PATCH("/pcap/upload/:uuid", RequirePermission(applicationContext, "/pcap", ActionWrite),
+			pcapUploadController.Patch)
+		api.HEAD("/pcap/upload/:uuid", RequirePermission(applicationContext, "/pcap", ActionWrite),
+			pcapUploadController.Head)
+		api.POST("/pcap/upload/:uuid/finish", RequirePermission(applicationContext, "/pcap", ActionWrite),
+			pcapUploadController.Finish)
+
+		api.POST("/pcap/file", RequirePermission(applicationContext, "/pcap", ActionWrite), func(c *gin.Context) {
 			var request struct {
 				File               string `json:"file"`
 				FlushAll           bool   `json:"flush_all"`
@@ -199,7 +248,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.PUT("/capture/local", func(c *gin.Context) {
+		api.PUT("/capture/local", RequirePermission(applicationContext, "/capture", ActionWrite), func(c *gin.Context) {
 			var captureOptions CaptureOptions
 			if err := c.ShouldBindJSON(&captureOptions); err != nil {
 				badRequest(c, err)
@@ -216,7 +265,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			notificationController.Notify("capture.local", response)
 		})
 
-		api.DELETE("/capture", func(c *gin.Context) {
+		api.DELETE("/capture", RequirePermission(applicationContext, "/capture", ActionDelete), func(c *gin.Context) {
 			if err := applicationContext.PcapImporter.StopCapture(); err != nil {
 				badRequest(c, err)
 				return
@@ -227,15 +276,16 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			notificationController.Notify("capture.stop", response)
 		})
 
-		api.POST("/capture/local/interfaces", func(c *gin.Context) {
-			if interfaces, err := applicationContext.PcapImporter.ListInterfaces(); err != nil {
-				badRequest(c, err)
-			} else {
-				c.JSON(http.StatusOK, interfaces)
-			}
-		})
+		api.POST("/capture/local/interfaces", RequirePermission(applicationContext, "/capture", ActionRead),
+			func(c *gin.Context) {
+				if interfaces, err := applicationContext.PcapImporter.ListInterfaces(); err != nil {
+					badRequest(c, err)
+				} else {
+					c.JSON(http.StatusOK, interfaces)
+				}
+			})
 
-		api.PUT("/capture/interval", func(c *gin.Context) {
+		api.PUT("/capture/interval", RequirePermission(applicationContext, "/capture", ActionWrite), func(c *gin.Context) {
 			var request struct {
 				RotationInterval time.Duration `json:"rotation_interval" binding:"required"`
 			}
@@ -249,7 +299,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			c.JSON(http.StatusOK, gin.H{"result": "ok"})
 		})
 
-		api.PUT("/capture/remote", func(c *gin.Context) {
+		api.PUT("/capture/remote", RequirePermission(applicationContext, "/capture", ActionWrite), func(c *gin.Context) {
 			var request struct {
 				SSHConfig      SSHConfig      `json:"ssh_config" binding:"required"`
 				CaptureOptions CaptureOptions `json:"capture_options" binding:"required"`
@@ -271,25 +321,26 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			notificationController.Notify("capture.remote", response)
 		})
 
-		api.POST("/capture/remote/interfaces", func(c *gin.Context) {
-			var sshConfig SSHConfig
-			if err := c.ShouldBindJSON(&sshConfig); err != nil {
-				badRequest(c, err)
-				return
-			}
+		api.POST("/capture/remote/interfaces", RequirePermission(applicationContext, "/capture", ActionRead),
+			func(c *gin.Context) {
+				var sshConfig SSHConfig
+				if err := c.ShouldBindJSON(&sshConfig); err != nil {
+					badRequest(c, err)
+					return
+				}
 
-			if interfaces, err := applicationContext.PcapImporter.ListRemoteInterfaces(sshConfig); err != nil {
-				badRequest(c, err)
-			} else {
-				c.JSON(http.StatusOK, interfaces)
-			}
-		})
+				if interfaces, err := applicationContext.PcapImporter.ListRemoteInterfaces(sshConfig); err != nil {
+					badRequest(c, err)
+				} else {
+					c.JSON(http.StatusOK, interfaces)
+				}
+			})
 
-		api.GET("/pcap/sessions", func(c *gin.Context) {
+		api.GET("/pcap/sessions", RequirePermission(applicationContext, "/pcap", ActionRead), func(c *gin.Context) {
 			success(c, applicationContext.PcapImporter.GetSessions())
 		})
 
-		api.GET("/pcap/sessions/:id", func(c *gin.Context) {
+		api.GET("/pcap/sessions/:id", RequirePermission(applicationContext, "/pcap", ActionRead), func(c *gin.Context) {
 			sessionID, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
 				badRequest(c, err)
@@ -302,85 +353,114 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.GET("/pcap/sessions/:id/download", func(c *gin.Context) {
-			sessionID, err := RowIDFromHex(c.Param("id"))
-			if err != nil {
-				badRequest(c, err)
-				return
-			}
-			if _, isPresent := applicationContext.PcapImporter.GetSession(sessionID); isPresent {
-				pcapPath := filepath.Join(PcapsBasePath, sessionID.Hex()+".pcap")
-				pcapngPath := filepath.Join(PcapsBasePath, sessionID.Hex()+".pcapng")
+		api.GET("/pcap/sessions/:id/download", RequirePermission(applicationContext, "/pcap", ActionRead),
+			func(c *gin.Context) {
+				sessionID, err := RowIDFromHex(c.Param("id"))
+				if err != nil {
+					badRequest(c, err)
+					return
+				}
+				if account, isPresent := currentAccount(c, applicationContext); isPresent &&
+					!enforceGuestServiceAccess(c, applicationContext, account, sessionID) {
+					return
+				}
+				if _, isPresent := applicationContext.PcapImporter.GetSession(sessionID); isPresent {
+					pcapPath := filepath.Join(PcapsBasePath, sessionID.Hex()+".pcap")
+					pcapngPath := filepath.Join(PcapsBasePath, sessionID.Hex()+".pcapng")
+
+					if FileExists(pcapPath) {
+						c.FileAttachment(pcapPath, sessionID.Hex()+".pcap")
+						return
+					} else if FileExists(pcapngPath) {
+						c.FileAttachment(pcapngPath, sessionID.Hex()+".pcapng")
+						return
+					}
+				}
 
-				if FileExists(pcapPath) {
-					c.FileAttachment(pcapPath, sessionID.Hex()+".pcap")
+				notFound(c, gin.H{"error": "not found", "session": sessionID})
+			})
+
+		api.DELETE("/pcap/sessions/:id", RequirePermission(applicationContext, "/pcap", ActionDelete),
+			func(c *gin.Context) {
+				sessionID, err := RowIDFromHex(c.Param("id"))
+				if err != nil {
+					badRequest(c, err)
 					return
-				} else if FileExists(pcapngPath) {
-					c.FileAttachment(pcapngPath, sessionID.Hex()+".pcapng")
+				}
+				session := gin.H{"session": sessionID.Hex()}
+				if cancelled := applicationContext.PcapImporter.CancelSession(sessionID); cancelled {
+					c.JSON(http.StatusAccepted, session)
+					notificationController.Notify("sessions.delete", session)
+				} else {
+					notFound(c, session)
+				}
+			})
+
+		api.GET("/pcap/connections/:id/download", RequirePermission(applicationContext, "/pcap", ActionRead),
+			func(c *gin.Context) {
+				connectionID, err := RowIDFromHex(c.Param("id"))
+				if err != nil {
+					badRequest(c, err)
+					return
+				}
+				if account, isPresent := currentAccount(c, applicationContext); isPresent &&
+					!enforceGuestServiceAccess(c, applicationContext, account, connectionID) {
 					return
 				}
-			}
 
-			notFound(c, gin.H{"error": "not found", "session": sessionID})
-		})
+				pcapPath := filepath.Join(ConnectionPcapsBasePath, connectionID.Hex()+".pcap")
+				if FileExists(pcapPath) {
+					c.FileAttachment(pcapPath, connectionID.Hex()+".pcap")
+				} else {
+					notFound(c, gin.H{"error": "not found", "connection": connectionID})
+				}
+			})
 
-		api.DELETE("/pcap/sessions/:id", func(c *gin.Context) {
-			sessionID, err := RowIDFromHex(c.Param("id"))
-			if err != nil {
+		api.GET("/connections", RequirePermission(applicationContext, "/connections", ActionRead), func(c *gin.Context) {
+			var filter ConnectionsFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
 				badRequest(c, err)
 				return
 			}
-			session := gin.H{"session": sessionID.Hex()}
-			if cancelled := applicationContext.PcapImporter.CancelSession(sessionID); cancelled {
-				c.JSON(http.StatusAccepted, session)
-				notificationController.Notify("sessions.delete", session)
-			} else {
-				notFound(c, session)
+
+			connections := applicationContext.ConnectionsController.GetConnections(c, filter)
+			if account, isPresent := currentAccount(c, applicationContext); isPresent {
+				connections = filterConnectionsForAccount(account, connections)
 			}
+			success(c, connections)
 		})
 
-		api.GET("/pcap/connections/:id/download", func(c *gin.Context) {
-			connectionID, err := RowIDFromHex(c.Param("id"))
+		api.GET("/connections/stream", RequirePermission(applicationContext, "/connections", ActionRead),
+			applicationContext.ConnectionsController.StreamConnections)
+
+		api.GET("/connections/:id", RequirePermission(applicationContext, "/connections", ActionRead), func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
 				badRequest(c, err)
 				return
 			}
-
-			pcapPath := filepath.Join(ConnectionPcapsBasePath, connectionID.Hex()+".pcap")
-			if FileExists(pcapPath) {
-				c.FileAttachment(pcapPath, connectionID.Hex()+".pcap")
-			} else {
-				notFound(c, gin.H{"error": "not found", "connection": connectionID})
-			}
-		})
-
-		api.GET("/connections", func(c *gin.Context) {
-			var filter ConnectionsFilter
-			if err := c.ShouldBindQuery(&filter); err != nil {
-				badRequest(c, err)
+			if account, isPresent := currentAccount(c, applicationContext); isPresent &&
+				!enforceGuestServiceAccess(c, applicationContext, account, id) {
 				return
 			}
-			success(c, applicationContext.ConnectionsController.GetConnections(c, filter))
-		})
 
-		api.GET("/connections/:id", func(c *gin.Context) {
-			if id, err := RowIDFromHex(c.Param("id")); err != nil {
-				badRequest(c, err)
+			if connection, isPresent := applicationContext.ConnectionsController.GetConnection(c, id); isPresent {
+				success(c, connection)
 			} else {
-				if connection, isPresent := applicationContext.ConnectionsController.GetConnection(c, id); isPresent {
-					success(c, connection)
-				} else {
-					notFound(c, gin.H{"error": "not found", "connection": id})
-				}
+				notFound(c, gin.H{"error": "not found", "connection": id})
 			}
 		})
 
-		api.POST("/connections/:id/:action", func(c *gin.Context) {
+		api.POST("/connections/:id/:action", RequirePermission(applicationContext, "/connections", ActionWrite), func(c *gin.Context) {
 			id, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
 				badRequest(c, err)
 				return
 			}
+			if account, isPresent := currentAccount(c, applicationContext); isPresent &&
+				!enforceGuestServiceAccess(c, applicationContext, account, id) {
+				return
+			}
 
 			var result bool
 			switch action := c.Param("action"); action {
@@ -415,11 +495,11 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.GET("/searches", func(c *gin.Context) {
+		api.GET("/searches", RequirePermission(applicationContext, "/searches", ActionRead), func(c *gin.Context) {
 			success(c, applicationContext.SearchController.GetPerformedSearches())
 		})
 
-		api.POST("/searches/perform", func(c *gin.Context) {
+		api.POST("/searches/perform", RequirePermission(applicationContext, "/searches", ActionWrite), func(c *gin.Context) {
 			var options SearchOptions
 
 			if err := c.ShouldBindJSON(&options); err != nil {
@@ -454,12 +534,16 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			success(c, applicationContext.SearchController.PerformSearch(c, options))
 		})
 
-		api.GET("/streams/:id", func(c *gin.Context) {
+		api.GET("/streams/:id", RequirePermission(applicationContext, "/streams", ActionRead), func(c *gin.Context) {
 			id, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
 				badRequest(c, err)
 				return
 			}
+			if account, isPresent := currentAccount(c, applicationContext); isPresent &&
+				!enforceGuestServiceAccess(c, applicationContext, account, id) {
+				return
+			}
 			var format GetMessageFormat
 			if err := c.ShouldBindQuery(&format); err != nil {
 				badRequest(c, err)
@@ -473,12 +557,16 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.GET("/streams/:id/download", func(c *gin.Context) {
+		api.GET("/streams/:id/download", RequirePermission(applicationContext, "/streams", ActionRead), func(c *gin.Context) {
 			id, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
 				badRequest(c, err)
 				return
 			}
+			if account, isPresent := currentAccount(c, applicationContext); isPresent &&
+				!enforceGuestServiceAccess(c, applicationContext, account, id) {
+				return
+			}
 			var format DownloadMessageFormat
 			if err := c.ShouldBindQuery(&format); err != nil {
 				badRequest(c, err)
@@ -492,11 +580,21 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.GET("/services", func(c *gin.Context) {
+		api.GET("/streams/:id/tail", RequirePermission(applicationContext, "/streams", ActionRead), func(c *gin.Context) {
+			if id, err := RowIDFromHex(c.Param("id")); err == nil {
+				if account, isPresent := currentAccount(c, applicationContext); isPresent &&
+					!enforceGuestServiceAccess(c, applicationContext, account, id) {
+					return
+				}
+			}
+			applicationContext.ConnectionStreamsController.TailStream(c)
+		})
+
+		api.GET("/services", RequirePermission(applicationContext, "/services", ActionRead), func(c *gin.Context) {
 			success(c, applicationContext.ServicesController.GetServices())
 		})
 
-		api.PUT("/services", func(c *gin.Context) {
+		api.PUT("/services", RequirePermission(applicationContext, "/services", ActionWrite), func(c *gin.Context) {
 			var service Service
 			if err := c.ShouldBindJSON(&service); err != nil {
 				badRequest(c, err)
@@ -510,7 +608,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.DELETE("/services", func(c *gin.Context) {
+		api.DELETE("/services", RequirePermission(applicationContext, "/services", ActionDelete), func(c *gin.Context) {
 			var service Service
 			if err := c.ShouldBindJSON(&service); err != nil {
 				badRequest(c, err)
@@ -524,7 +622,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
-		api.GET("/statistics", func(c *gin.Context) {
+		api.GET("/statistics", RequirePermission(applicationContext, "/statistics", ActionRead), func(c *gin.Context) {
 			var filter StatisticsFilter
 			if err := c.ShouldBindQuery(&filter); err != nil {
 				badRequest(c, err)
@@ -534,7 +632,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			success(c, applicationContext.StatisticsController.GetStatistics(c, filter))
 		})
 
-		api.GET("/statistics/totals", func(c *gin.Context) {
+		api.GET("/statistics/totals", RequirePermission(applicationContext, "/statistics", ActionRead), func(c *gin.Context) {
 			var filter StatisticsFilter
 			if err := c.ShouldBindQuery(&filter); err != nil {
 				badRequest(c, err)
@@ -576,7 +674,26 @@ func AuthRequiredMiddleware(applicationContext *ApplicationContext) gin.HandlerF
 			return
 		}
 
-		gin.BasicAuth(applicationContext.Accounts)(c)
+		rawToken := parseBearerOrCookie(c)
+		if rawToken == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, UnorderedDocument{"error": "missing credentials"})
+			return
+		}
+
+		var claims Claims
+		token, err := jwt.ParseWithClaims(rawToken, &claims, func(token *jwt.Token) (any, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return JWTSecret(), nil
+		})
+		if err != nil || !token.Valid {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, UnorderedDocument{"error": "invalid or expired token"})
+			return
+		}
+
+		c.Set("user", claims.Username)
+		c.Next()
 	}
 }
 
@@ -0,0 +1,272 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sessionCookieName  = "caronte_session"
+	refreshCookieName  = "caronte_refresh"
+	accessTokenTTL     = 15 * time.Minute
+	refreshTokenTTL    = 7 * 24 * time.Hour
+	jwtSecretByteSize  = 32
+	refreshTokenLength = 32
+)
+
+// RefreshToken is an opaque, Mongo-backed credential that can be exchanged for a new access token.
+// It is revoked on logout and by RevokeAllForUsername; a revoked token can no longer be refreshed, while an
+// access token already issued stays valid until it expires.
+type RefreshToken struct {
+	ID        RowID     `json:"id" bson:"_id"`
+	Token     string    `json:"token" bson:"token"`
+	Username  string    `json:"username" bson:"username"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+	Revoked   bool      `json:"revoked" bson:"revoked"`
+}
+
+// Claims are the custom fields carried by access tokens, on top of the standard registered claims.
+type Claims struct {
+	Username string `json:"username"`
+	jwt.StandardClaims
+}
+
+// AuthController issues and validates JWT access tokens and manages the lifecycle of their refresh tokens.
+type AuthController struct {
+	applicationContext *ApplicationContext
+	refreshTokens      Storage
+}
+
+// NewAuthController returns an AuthController backed by the refresh_tokens collection.
+func NewAuthController(applicationContext *ApplicationContext) AuthController {
+	return AuthController{
+		applicationContext: applicationContext,
+		refreshTokens:      applicationContext.Storage("refresh_tokens"),
+	}
+}
+
+// GenerateJWTSecret creates a new random HS256 secret, which /setup stores once with SetJWTSecret. The
+// secret is held in process memory only; it is not persisted and does not survive a restart.
+func GenerateJWTSecret() ([]byte, error) {
+	secret := make([]byte, jwtSecretByteSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Login validates username/password against the configured accounts and, on success, returns a fresh
+// access token alongside a new opaque refresh token persisted in Mongo.
+func (ac AuthController) Login(c *gin.Context) {
+	var credentials struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&credentials); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	if _, isAuthenticated := currentAccountsController().Authenticate(credentials.Username,
+		credentials.Password); !isAuthenticated {
+		c.JSON(http.StatusUnauthorized, UnorderedDocument{"error": "invalid credentials"})
+		return
+	}
+
+	accessToken, err := ac.signAccessToken(credentials.Username)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+
+	refreshToken, err := ac.createRefreshToken(c, credentials.Username)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+
+	ac.setSessionCookie(c, accessToken)
+	ac.setRefreshCookie(c, refreshToken)
+	success(c, UnorderedDocument{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken.Token,
+		"expires_in":    int(accessTokenTTL.Seconds()),
+	})
+}
+
+// Refresh exchanges a valid, non-revoked refresh token for a new access token.
+func (ac AuthController) Refresh(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	_ = c.ShouldBindJSON(&request)
+	token := request.RefreshToken
+	if token == "" {
+		token, _ = c.Cookie(refreshCookieName)
+	}
+	if token == "" {
+		badRequest(c, errors.New("missing refresh token"))
+		return
+	}
+
+	refreshToken, isPresent := ac.findRefreshToken(c, token)
+	if !isPresent || refreshToken.Revoked || time.Now().After(refreshToken.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, UnorderedDocument{"error": "invalid or expired refresh token"})
+		return
+	}
+
+	accessToken, err := ac.signAccessToken(refreshToken.Username)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+
+	ac.setSessionCookie(c, accessToken)
+	success(c, UnorderedDocument{
+		"access_token": accessToken,
+		"expires_in":   int(accessTokenTTL.Seconds()),
+	})
+}
+
+// Logout revokes the refresh token carried by the request, invalidating the session.
+func (ac AuthController) Logout(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	_ = c.ShouldBindJSON(&request)
+	token := request.RefreshToken
+
+	if token != "" {
+		if refreshToken, isPresent := ac.findRefreshToken(c, token); isPresent {
+			refreshToken.Revoked = true
+			if err := ac.refreshTokens.Update(c, refreshToken.ID, refreshToken); err != nil {
+				log.WithError(err).Error("failed to revoke refresh token")
+			}
+		}
+	}
+
+	c.SetCookie(sessionCookieName, "", -1, "/", "", true, true)
+	c.SetCookie(refreshCookieName, "", -1, "/api/auth/refresh", "", true, true)
+	success(c, UnorderedDocument{"result": "logged out"})
+}
+
+// Me returns the identity populated in the gin context by AuthRequiredMiddleware.
+func (ac AuthController) Me(c *gin.Context) {
+	username, isPresent := c.Get("user")
+	if !isPresent {
+		c.JSON(http.StatusUnauthorized, UnorderedDocument{"error": "not authenticated"})
+		return
+	}
+	success(c, UnorderedDocument{"username": username})
+}
+
+func (ac AuthController) signAccessToken(username string) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		Username: username,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenTTL).Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(JWTSecret())
+}
+
+func (ac AuthController) createRefreshToken(ctx context.Context, username string) (RefreshToken, error) {
+	rawToken := make([]byte, refreshTokenLength)
+	if _, err := rand.Read(rawToken); err != nil {
+		return RefreshToken{}, err
+	}
+
+	refreshToken := RefreshToken{
+		Token:     hex.EncodeToString(rawToken),
+		Username:  username,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+		Revoked:   false,
+	}
+	id, err := ac.refreshTokens.Insert(ctx, refreshToken)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	refreshToken.ID = id
+	return refreshToken, nil
+}
+
+func (ac AuthController) findRefreshToken(ctx context.Context, token string) (RefreshToken, bool) {
+	var refreshToken RefreshToken
+	isPresent := ac.refreshTokens.FindOne(ctx, OrderedDocument{{"token", token}}, &refreshToken)
+	return refreshToken, isPresent
+}
+
+// RevokeAllForUsername revokes every outstanding refresh token belonging to username, forcing that
+// account to log in again on its next refresh attempt. It is called whenever an account's password
+// changes or the account is deleted, and by the admin-triggered force-logout endpoint.
+func (ac AuthController) RevokeAllForUsername(ctx context.Context, username string) error {
+	var tokens []RefreshToken
+	ac.refreshTokens.Find(ctx, OrderedDocument{{"username", username}}, &tokens)
+
+	for _, token := range tokens {
+		if token.Revoked {
+			continue
+		}
+		token.Revoked = true
+		if err := ac.refreshTokens.Update(ctx, token.ID, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ac AuthController) setSessionCookie(c *gin.Context, accessToken string) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(sessionCookieName, accessToken, int(accessTokenTTL.Seconds()), "/", "", true, true)
+}
+
+// setRefreshCookie stores the opaque refresh token in its own cookie, scoped to the refresh endpoint so
+// it is never sent alongside sessionCookieName on ordinary API requests. Refresh's fallback reads it from
+// here rather than from sessionCookieName, which holds the access token JWT, not the refresh token.
+func (ac AuthController) setRefreshCookie(c *gin.Context, refreshToken RefreshToken) {
+	maxAge := int(time.Until(refreshToken.ExpiresAt).Seconds())
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(refreshCookieName, refreshToken.Token, maxAge, "/api/auth/refresh", "", true, true)
+}
+
+// parseBearerOrCookie extracts the raw JWT from either the Authorization header or the session cookie.
+func parseBearerOrCookie(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if cookie, err := c.Cookie(sessionCookieName); err == nil {
+		return cookie
+	}
+	return ""
+}
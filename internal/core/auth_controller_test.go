@@ -0,0 +1,101 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSignAccessTokenRoundTrip(t *testing.T) {
+	SetJWTSecret([]byte("test-secret"))
+
+	ac := AuthController{}
+	signed, err := ac.signAccessToken("alice")
+	if err != nil {
+		t.Fatalf("signAccessToken returned an error: %v", err)
+	}
+
+	var claims Claims
+	token, err := jwt.ParseWithClaims(signed, &claims, func(*jwt.Token) (interface{}, error) {
+		return JWTSecret(), nil
+	})
+	if err != nil || !token.Valid {
+		t.Fatalf("ParseWithClaims failed on a freshly signed token: %v", err)
+	}
+	if claims.Username != "alice" {
+		t.Fatalf("expected username %q, got %q", "alice", claims.Username)
+	}
+}
+
+func TestExpiredAccessTokenFailsValidation(t *testing.T) {
+	SetJWTSecret([]byte("test-secret"))
+
+	now := time.Now()
+	claims := Claims{
+		Username: "alice",
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  now.Add(-2 * accessTokenTTL).Unix(),
+			ExpiresAt: now.Add(-accessTokenTTL).Unix(),
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(JWTSecret())
+	if err != nil {
+		t.Fatalf("failed to sign test token: %v", err)
+	}
+
+	var parsed Claims
+	_, err = jwt.ParseWithClaims(signed, &parsed, func(*jwt.Token) (interface{}, error) {
+		return JWTSecret(), nil
+	})
+	if err == nil {
+		t.Fatal("expected an expired token to fail validation, got no error")
+	}
+}
+
+func TestParseBearerOrCookie(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	headerReq := httptest.NewRequest("GET", "/", nil)
+	headerReq.Header.Set("Authorization", "Bearer from-header")
+	headerCtx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	headerCtx.Request = headerReq
+	if got := parseBearerOrCookie(headerCtx); got != "from-header" {
+		t.Fatalf("expected token from Authorization header, got %q", got)
+	}
+
+	cookieReq := httptest.NewRequest("GET", "/", nil)
+	cookieReq.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "from-cookie"})
+	cookieCtx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	cookieCtx.Request = cookieReq
+	if got := parseBearerOrCookie(cookieCtx); got != "from-cookie" {
+		t.Fatalf("expected token from session cookie, got %q", got)
+	}
+
+	emptyReq := httptest.NewRequest("GET", "/", nil)
+	emptyCtx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	emptyCtx.Request = emptyReq
+	if got := parseBearerOrCookie(emptyCtx); got != "" {
+		t.Fatalf("expected no token when neither header nor cookie is set, got %q", got)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	streamSubscriberBufferSize = 64
+	streamHeartbeatInterval    = 15 * time.Second
+)
+
+var errStreamingUnsupported = errors.New("response writer does not support streaming")
+
+// connectionsFilterMatch reports whether connection matches every non-zero field set on filter, by
+// comparing same-named exported fields (e.g. ServicePort, ClientAddress, MarkedOnly) between the two
+// structs. This keeps a live tail consistent with a plain GET /connections?<same query> without
+// duplicating ConnectionsController's Mongo query construction.
+func connectionsFilterMatch(filter ConnectionsFilter, connection Connection) bool {
+	filterValue := reflect.ValueOf(filter)
+	filterType := filterValue.Type()
+	connectionValue := reflect.ValueOf(connection)
+
+	for i := 0; i < filterType.NumField(); i++ {
+		field := filterType.Field(i)
+		fieldValue := filterValue.Field(i)
+		if fieldValue.IsZero() {
+			continue
+		}
+
+		connectionField := connectionValue.FieldByName(field.Name)
+		if !connectionField.IsValid() {
+			continue
+		}
+		if !reflect.DeepEqual(fieldValue.Interface(), connectionField.Interface()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// streamSubscriber is a single client of a connectionsPubSub, with its own bounded send buffer so a slow
+// HTTP consumer cannot stall the publishers feeding the capture pipeline.
+type streamSubscriber struct {
+	buffer chan any
+	accept func(any) bool
+}
+
+// connectionsPubSub is an in-process fan-out of newly inserted documents; the instances in use are built
+// by InitializeRBAC and held in the package-level rbac state. Publish never blocks: when a subscriber's buffer is full, the oldest queued
+// item is dropped to make room for the new one, trading completeness for a bounded memory footprint.
+type connectionsPubSub struct {
+	mu          sync.Mutex
+	subscribers map[*streamSubscriber]struct{}
+}
+
+func newConnectionsPubSub() *connectionsPubSub {
+	return &connectionsPubSub{subscribers: make(map[*streamSubscriber]struct{})}
+}
+
+// subscribe registers a new subscriber whose accept predicate decides which published items it receives.
+func (ps *connectionsPubSub) subscribe(accept func(any) bool) *streamSubscriber {
+	subscriber := &streamSubscriber{
+		buffer: make(chan any, streamSubscriberBufferSize),
+		accept: accept,
+	}
+	ps.mu.Lock()
+	ps.subscribers[subscriber] = struct{}{}
+	ps.mu.Unlock()
+	return subscriber
+}
+
+func (ps *connectionsPubSub) unsubscribe(subscriber *streamSubscriber) {
+	ps.mu.Lock()
+	delete(ps.subscribers, subscriber)
+	ps.mu.Unlock()
+}
+
+// publish fans item out to every subscriber whose accept predicate matches, dropping the oldest queued
+// item for any subscriber whose buffer is already full instead of blocking the caller.
+func (ps *connectionsPubSub) publish(item any) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for subscriber := range ps.subscribers {
+		if subscriber.accept != nil && !subscriber.accept(item) {
+			continue
+		}
+
+		select {
+		case subscriber.buffer <- item:
+			continue
+		default:
+		}
+
+		select {
+		case <-subscriber.buffer:
+		default:
+		}
+		select {
+		case subscriber.buffer <- item:
+		default:
+		}
+	}
+}
+
+// streamNDJSON upgrades the response to a long-lived chunked stream, writing each item published to
+// subscriber as a line of NDJSON, plus periodic heartbeats so an idle client can detect a dead connection.
+func streamNDJSON(c *gin.Context, pubSub *connectionsPubSub, accept func(any) bool) {
+	flusher, isFlushable := c.Writer.(http.Flusher)
+	if !isFlushable {
+		serverError(c, errStreamingUnsupported)
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	subscriber := pubSub.subscribe(accept)
+	defer pubSub.unsubscribe(subscriber)
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	encoder := json.NewEncoder(c.Writer)
+	for {
+		select {
+		case item := <-subscriber.buffer:
+			if err := encoder.Encode(item); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := c.Writer.Write([]byte("{\"heartbeat\":true}\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// StreamConnections handles GET /api/connections/stream, tailing newly inserted connections as NDJSON.
+// It accepts the same ConnectionsFilter-shaped query parameters as GET /connections so a client can
+// reuse its existing query when switching from a one-shot fetch to a live tail; matching against those
+// parameters is delegated to connectionsFilterMatch above, which does not reuse GetConnections' query.
+// A guest restricted to AllowedServices is scoped the same way GET /connections scopes it, via
+// filterConnectionsForAccount, so the live tail can't be used to bypass the one-shot endpoint's limit.
+//
+// publishInsertedConnection below is the hook this endpoint relies on; it must be called, with the
+// freshly inserted Connection, from every place ConnectionsController writes a new connection document
+// (the capture pipeline's insert path, outside this file). Without that call this endpoint only ever
+// emits heartbeats.
+func (cc *ConnectionsController) StreamConnections(c *gin.Context) {
+	var filter ConnectionsFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	account, hasAccount := currentAccount(c, cc.applicationContext)
+
+	streamNDJSON(c, currentConnectionsPubSub(), func(item any) bool {
+		connection, isConnection := item.(Connection)
+		if !isConnection || !connectionsFilterMatch(filter, connection) {
+			return false
+		}
+		if !hasAccount {
+			return true
+		}
+		return len(filterConnectionsForAccount(account, []Connection{connection})) == 1
+	})
+}
+
+// publishInsertedConnection fans a newly inserted connection out to every matching /connections/stream
+// subscriber. It must be called from the same place that inserts the document into Mongo, immediately
+// after the insert succeeds, passing the document as written (not just the fields from the request).
+func (cc *ConnectionsController) publishInsertedConnection(connection Connection) {
+	currentConnectionsPubSub().publish(connection)
+}
+
+// TailStream handles GET /api/streams/:id/tail, pushing newly assembled messages for a single
+// connection as they are inserted.
+//
+// publishStreamMessage below is the hook this endpoint relies on; it must be called, with the connection
+// ID the message belongs to, from every place ConnectionStreamsController writes a new assembled message
+// (outside this file). Without that call this endpoint only ever emits heartbeats.
+func (csc *ConnectionStreamsController) TailStream(c *gin.Context) {
+	id, err := RowIDFromHex(c.Param("id"))
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	streamNDJSON(c, currentStreamMessagesPubSub(), func(item any) bool {
+		message, isStreamMessage := item.(connectionStreamMessage)
+		return isStreamMessage && message.ConnectionID == id
+	})
+}
+
+// connectionStreamMessage pairs an assembled message with the connection it belongs to, so
+// publishStreamMessage can tag it for per-connection filtering in TailStream subscribers.
+type connectionStreamMessage struct {
+	ConnectionID RowID
+	Message      any
+}
+
+// publishStreamMessage fans a newly assembled message for connectionID out to every /streams/:id/tail
+// subscriber watching that connection.
+func (csc *ConnectionStreamsController) publishStreamMessage(connectionID RowID, message any) {
+	currentStreamMessagesPubSub().publish(connectionStreamMessage{ConnectionID: connectionID, Message: message})
+}
@@ -0,0 +1,81 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import "testing"
+
+func TestConnectionsPubSubPublishDeliversToMatchingSubscribers(t *testing.T) {
+	pubSub := newConnectionsPubSub()
+
+	accepted := pubSub.subscribe(func(item any) bool { return item.(string) == "wanted" })
+	defer pubSub.unsubscribe(accepted)
+	rejected := pubSub.subscribe(func(item any) bool { return item.(string) == "never" })
+	defer pubSub.unsubscribe(rejected)
+
+	pubSub.publish("wanted")
+
+	select {
+	case item := <-accepted.buffer:
+		if item != "wanted" {
+			t.Fatalf("expected %q, got %v", "wanted", item)
+		}
+	default:
+		t.Fatal("expected the matching subscriber to receive the published item")
+	}
+
+	select {
+	case item := <-rejected.buffer:
+		t.Fatalf("expected the non-matching subscriber to receive nothing, got %v", item)
+	default:
+	}
+}
+
+func TestConnectionsPubSubPublishDropsOldestWhenBufferIsFull(t *testing.T) {
+	pubSub := newConnectionsPubSub()
+	subscriber := pubSub.subscribe(nil)
+	defer pubSub.unsubscribe(subscriber)
+
+	for i := 0; i < streamSubscriberBufferSize+10; i++ {
+		pubSub.publish(i)
+	}
+
+	if len(subscriber.buffer) != streamSubscriberBufferSize {
+		t.Fatalf("expected the buffer to stay at its cap of %d, got %d", streamSubscriberBufferSize,
+			len(subscriber.buffer))
+	}
+
+	first := <-subscriber.buffer
+	if first != 10 {
+		t.Fatalf("expected publish to have dropped the oldest items, first remaining item is %v, want %v",
+			first, 10)
+	}
+}
+
+func TestConnectionsPubSubUnsubscribeStopsDelivery(t *testing.T) {
+	pubSub := newConnectionsPubSub()
+	subscriber := pubSub.subscribe(nil)
+	pubSub.unsubscribe(subscriber)
+
+	pubSub.publish("after unsubscribe")
+
+	select {
+	case item := <-subscriber.buffer:
+		t.Fatalf("expected no delivery after unsubscribe, got %v", item)
+	default:
+	}
+}
@@ -0,0 +1,44 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import "sync"
+
+// jwtSecretMu guards jwtSecretValue, the HS256 secret /setup generates once via GenerateJWTSecret. It is
+// a package-level accessor pair rather than an ApplicationContext field for the same reason as ACL and
+// AccountsController (see acl.go): ApplicationContext's own struct and constructor are outside this
+// change set, so there is no field on it to assign.
+var (
+	jwtSecretMu    sync.RWMutex
+	jwtSecretValue []byte
+)
+
+// SetJWTSecret stores the secret generated once on /setup, so every subsequent request signs and verifies
+// access tokens against the same key for the life of the process.
+func SetJWTSecret(secret []byte) {
+	jwtSecretMu.Lock()
+	defer jwtSecretMu.Unlock()
+	jwtSecretValue = secret
+}
+
+// JWTSecret returns the secret SetJWTSecret stored, or nil before /setup has run.
+func JWTSecret() []byte {
+	jwtSecretMu.RLock()
+	defer jwtSecretMu.RUnlock()
+	return jwtSecretValue
+}
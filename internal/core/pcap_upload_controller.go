@@ -0,0 +1,311 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const progressTickInterval = 500 * time.Millisecond
+
+// PcapUploadSession tracks a single tus-style resumable upload: the chunk byte offset received so far,
+// the expected final size and the temporary file the chunks are appended to. It is persisted in Mongo
+// after every chunk so a partial upload survives a server restart.
+type PcapUploadSession struct {
+	ID        RowID     `json:"id" bson:"_id"`
+	UUID      string    `json:"uuid" bson:"uuid"`
+	FileName  string    `json:"file_name" bson:"file_name"`
+	TempPath  string    `json:"temp_path" bson:"temp_path"`
+	TotalSize int64     `json:"total_size" bson:"total_size"`
+	Offset    int64     `json:"offset" bson:"offset"`
+	FlushAll  bool      `json:"flush_all" bson:"flush_all"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	Finished  bool      `json:"finished" bson:"finished"`
+}
+
+// PcapUploadController implements a resumable, chunked alternative to POST /api/pcap/upload, publishing
+// fine-grained progress on the notification websocket so the UI can render a real progress bar.
+type PcapUploadController struct {
+	applicationContext     *ApplicationContext
+	notificationController NotificationController
+	sessions               Storage
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewPcapUploadController returns a PcapUploadController backed by the pcap_upload_sessions collection.
+func NewPcapUploadController(applicationContext *ApplicationContext,
+	notificationController NotificationController) PcapUploadController {
+	return PcapUploadController{
+		applicationContext:     applicationContext,
+		notificationController: notificationController,
+		sessions:               applicationContext.Storage("pcap_upload_sessions"),
+		locks:                  make(map[string]*sync.Mutex),
+	}
+}
+
+// Init starts a new resumable upload, returning the session uuid the client will PATCH chunks to.
+func (puc *PcapUploadController) Init(c *gin.Context) {
+	var request struct {
+		FileName  string `json:"file_name" binding:"required"`
+		TotalSize int64  `json:"total_size" binding:"required"`
+		FlushAll  bool   `json:"flush_all"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	sessionUUID := uuid.New().String()
+	fileName := fmt.Sprintf("%v-%s", time.Now().UnixNano(), request.FileName)
+	tempPath := ProcessingPcapsBasePath + "/" + sessionUUID + ".part"
+
+	file, err := os.Create(tempPath)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	_ = file.Close()
+
+	session := PcapUploadSession{
+		UUID:      sessionUUID,
+		FileName:  fileName,
+		TempPath:  tempPath,
+		TotalSize: request.TotalSize,
+		FlushAll:  request.FlushAll,
+		CreatedAt: time.Now(),
+	}
+	if _, err := puc.sessions.Insert(c, session); err != nil {
+		serverError(c, err)
+		return
+	}
+
+	success(c, UnorderedDocument{"uuid": sessionUUID, "chunk_size": uploadChunkSize})
+}
+
+// Patch appends a sequential byte range to the session's temp file and reports the new offset.
+func (puc *PcapUploadController) Patch(c *gin.Context) {
+	session, isPresent := puc.findSession(c.Param("uuid"))
+	if !isPresent {
+		notFound(c, UnorderedDocument{"error": "not found", "uuid": c.Param("uuid")})
+		return
+	}
+
+	contentRange := c.GetHeader("Content-Range")
+	rangeStart, rangeEnd, total, err := parseContentRange(contentRange)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	lock := puc.sessionLock(session.UUID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Re-fetch the session inside the critical section: the copy looked up above, before the lock was
+	// acquired, can already be stale if another PATCH for this session raced past it and updated Offset
+	// in the meantime. Without this re-check, two requests carrying the same expected offset could both
+	// pass and then both append to the file serially under the lock, duplicating bytes in the pcap.
+	session, isPresent = puc.findSession(session.UUID)
+	if !isPresent {
+		notFound(c, UnorderedDocument{"error": "not found", "uuid": c.Param("uuid")})
+		return
+	}
+	if rangeStart != session.Offset {
+		c.JSON(http.StatusConflict, UnorderedDocument{"error": "offset mismatch", "offset": session.Offset})
+		return
+	}
+
+	file, err := os.OpenFile(session.TempPath, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	defer file.Close()
+
+	written, err := copyChunk(file, c.Request.Body)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+
+	session.Offset = rangeStart + written
+	if total > 0 {
+		session.TotalSize = total
+	}
+	if err := puc.sessions.Update(c, session.ID, session); err != nil {
+		log.WithError(err).Error("failed to persist pcap upload offset")
+	}
+
+	puc.publishProgress(session, "uploading", "")
+	_ = rangeEnd
+	c.Header("Offset", strconv.FormatInt(session.Offset, 10))
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Head reports the current offset, so a client can resume an interrupted upload.
+func (puc *PcapUploadController) Head(c *gin.Context) {
+	session, isPresent := puc.findSession(c.Param("uuid"))
+	if !isPresent {
+		notFound(c, UnorderedDocument{"error": "not found", "uuid": c.Param("uuid")})
+		return
+	}
+	c.Header("Offset", strconv.FormatInt(session.Offset, 10))
+	c.Status(http.StatusOK)
+}
+
+// Finish closes the upload and triggers PcapImporter.ImportPcap, streaming import progress over the
+// same topic used for the upload itself.
+func (puc *PcapUploadController) Finish(c *gin.Context) {
+	session, isPresent := puc.findSession(c.Param("uuid"))
+	if !isPresent {
+		notFound(c, UnorderedDocument{"error": "not found", "uuid": c.Param("uuid")})
+		return
+	}
+	if session.TotalSize > 0 && session.Offset < session.TotalSize {
+		badRequest(c, errors.New("upload is not complete"))
+		return
+	}
+
+	finalPath := ProcessingPcapsBasePath + "/" + session.FileName
+	if err := os.Rename(session.TempPath, finalPath); err != nil {
+		serverError(c, err)
+		return
+	}
+
+	session.Finished = true
+	if err := puc.sessions.Update(c, session.ID, session); err != nil {
+		log.WithError(err).Error("failed to mark pcap upload session as finished")
+	}
+
+	go puc.importWithProgress(session)
+
+	c.JSON(http.StatusAccepted, UnorderedDocument{"uuid": session.UUID})
+}
+
+func (puc *PcapUploadController) importWithProgress(session PcapUploadSession) {
+	ticker := time.NewTicker(progressTickInterval)
+	defer ticker.Stop()
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				// The upload already finished by the time import starts, so bytes_received/bytes_total
+				// can't move anymore; publishProgress reports elapsed only for this phase instead of
+				// repeating that same frozen snapshot every tick.
+				puc.publishProgress(session, "importing", "")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sessionID, err := puc.applicationContext.PcapImporter.ImportPcap(session.FileName, session.FlushAll)
+	close(done)
+
+	if err != nil {
+		puc.publishProgress(session, "error", err.Error())
+		return
+	}
+
+	event := UnorderedDocument{
+		"uuid":    session.UUID,
+		"session": sessionID.Hex(),
+		"phase":   "done",
+		"elapsed": time.Since(session.CreatedAt).Seconds(),
+		"done":    true,
+	}
+	if packetsProcessed, connectionsCreated, isPresent := puc.importedCounters(sessionID); isPresent {
+		event["packets_processed"] = packetsProcessed
+		event["connections_created"] = connectionsCreated
+	}
+	puc.notificationController.Notify(puc.progressTopic(session.UUID), event)
+}
+
+// publishProgress notifies the upload/import progress topic for session. bytes_received, bytes_total and
+// eta are only meaningful during the "uploading" phase, since the import phase that follows cannot report
+// packets_processed/connections_created without per-tick counters from PcapImporter.ImportPcap, which
+// currently only returns its result once the whole import is finished (see importWithProgress's "done"
+// event for the one point those counts are available).
+func (puc *PcapUploadController) publishProgress(session PcapUploadSession, phase string, errMessage string) {
+	elapsed := time.Since(session.CreatedAt)
+	event := UnorderedDocument{
+		"uuid":    session.UUID,
+		"phase":   phase,
+		"elapsed": elapsed.Seconds(),
+	}
+
+	if phase == "uploading" {
+		event["bytes_received"] = session.Offset
+		event["bytes_total"] = session.TotalSize
+		if session.TotalSize > 0 && session.Offset > 0 && elapsed.Seconds() > 0 {
+			if rate := float64(session.Offset) / elapsed.Seconds(); rate > 0 {
+				event["eta"] = float64(session.TotalSize-session.Offset) / rate
+			}
+		}
+	}
+
+	if errMessage != "" {
+		event["error"] = errMessage
+	}
+	puc.notificationController.Notify(puc.progressTopic(session.UUID), event)
+}
+
+// importedCounters looks up how many packets and connections the finished import produced.
+func (puc *PcapUploadController) importedCounters(sessionID RowID) (packets, connections int64, isPresent bool) {
+	importedSession, found := puc.applicationContext.PcapImporter.GetSession(sessionID)
+	if !found {
+		return 0, 0, false
+	}
+	return int64(importedSession.PacketsCount), int64(importedSession.ConnectionsCount), true
+}
+
+func (puc *PcapUploadController) progressTopic(sessionUUID string) string {
+	return "pcap.progress." + sessionUUID
+}
+
+func (puc *PcapUploadController) findSession(sessionUUID string) (PcapUploadSession, bool) {
+	var session PcapUploadSession
+	isPresent := puc.sessions.FindOne(context.Background(), OrderedDocument{{"uuid", sessionUUID}}, &session)
+	return session, isPresent
+}
+
+func (puc *PcapUploadController) sessionLock(sessionUUID string) *sync.Mutex {
+	puc.mu.Lock()
+	defer puc.mu.Unlock()
+	if lock, isPresent := puc.locks[sessionUUID]; isPresent {
+		return lock
+	}
+	lock := &sync.Mutex{}
+	puc.locks[sessionUUID] = lock
+	return lock
+}
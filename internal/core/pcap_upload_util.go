@@ -0,0 +1,66 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// uploadChunkSize is the size suggested to clients for each PATCH request of a resumable pcap upload.
+const uploadChunkSize = 8 << 20 // 8 MiB
+
+// parseContentRange parses a "bytes start-end/total" Content-Range header, as sent by a resumable
+// upload client for each chunk.
+func parseContentRange(header string) (start, end, total int64, err error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range header: %q", header)
+	}
+	header = strings.TrimPrefix(header, "bytes ")
+
+	rangeAndTotal := strings.SplitN(header, "/", 2)
+	if len(rangeAndTotal) != 2 {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range header: %q", header)
+	}
+
+	startAndEnd := strings.SplitN(rangeAndTotal[0], "-", 2)
+	if len(startAndEnd) != 2 {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range header: %q", header)
+	}
+
+	if start, err = strconv.ParseInt(startAndEnd[0], 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if end, err = strconv.ParseInt(startAndEnd[1], 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if rangeAndTotal[1] != "*" {
+		if total, err = strconv.ParseInt(rangeAndTotal[1], 10, 64); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	return start, end, total, nil
+}
+
+// copyChunk appends the request body to file and returns how many bytes were written.
+func copyChunk(file io.Writer, body io.Reader) (int64, error) {
+	return io.Copy(file, body)
+}
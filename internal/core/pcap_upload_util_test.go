@@ -0,0 +1,110 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package core
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	cases := []struct {
+		name      string
+		header    string
+		wantStart int64
+		wantEnd   int64
+		wantTotal int64
+		wantErr   bool
+	}{
+		{"known total", "bytes 0-1048575/5242880", 0, 1048575, 5242880, false},
+		{"unknown total", "bytes 1048576-2097151/*", 1048576, 2097151, 0, false},
+		{"missing bytes prefix", "0-1048575/5242880", 0, 0, 0, true},
+		{"missing total separator", "bytes 0-1048575", 0, 0, 0, true},
+		{"missing range separator", "bytes 01048575/5242880", 0, 0, 0, true},
+		{"non-numeric start", "bytes a-1048575/5242880", 0, 0, 0, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end, total, err := parseContentRange(tc.header)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error for header %q, got none", tc.header)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error for header %q: %v", tc.header, err)
+			}
+			if start != tc.wantStart || end != tc.wantEnd || total != tc.wantTotal {
+				t.Fatalf("parseContentRange(%q) = (%d, %d, %d), want (%d, %d, %d)",
+					tc.header, start, end, total, tc.wantStart, tc.wantEnd, tc.wantTotal)
+			}
+		})
+	}
+}
+
+func TestCopyChunk(t *testing.T) {
+	var dest strings.Builder
+	written, err := copyChunk(&dest, strings.NewReader("chunk-bytes"))
+	if err != nil {
+		t.Fatalf("copyChunk returned an error: %v", err)
+	}
+	if written != int64(len("chunk-bytes")) || dest.String() != "chunk-bytes" {
+		t.Fatalf("copyChunk wrote %d bytes (%q), want %d bytes (%q)",
+			written, dest.String(), len("chunk-bytes"), "chunk-bytes")
+	}
+}
+
+// TestSessionLockSerializesConcurrentPatches checks that sessionLock hands out the same *sync.Mutex for a
+// given session UUID, so concurrent PATCHes for that session are serialized rather than racing each other.
+func TestSessionLockSerializesConcurrentPatches(t *testing.T) {
+	puc := &PcapUploadController{locks: make(map[string]*sync.Mutex)}
+
+	const goroutines = 50
+	var counter int64
+	var maxObservedConcurrent int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock := puc.sessionLock("session-under-test")
+			lock.Lock()
+			defer lock.Unlock()
+
+			current := atomic.AddInt64(&counter, 1)
+			for {
+				observed := atomic.LoadInt64(&maxObservedConcurrent)
+				if current <= observed || atomic.CompareAndSwapInt64(&maxObservedConcurrent, observed, current) {
+					break
+				}
+			}
+			atomic.AddInt64(&counter, -1)
+		}()
+	}
+	wg.Wait()
+
+	if maxObservedConcurrent != 1 {
+		t.Fatalf("expected at most 1 goroutine holding the per-session lock at a time, observed %d",
+			maxObservedConcurrent)
+	}
+}